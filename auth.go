@@ -0,0 +1,255 @@
+// Copyright (c) 2012-today José Nieto, https://xiam.io
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+const (
+	sessionCookieName = "hyperfox_session"
+	csrfCookieName    = "hyperfox_csrf"
+	csrfHeaderName    = "X-CSRF-Token"
+
+	sessionTTL = 24 * time.Hour
+)
+
+// authSecret is the shared secret this instance was started with, taken
+// from config or the HYPERFOX_SECRET environment variable. An empty
+// secret disables the whole auth subsystem, which is the default for
+// the common 127.0.0.1-only development case.
+var authSecret string
+
+func init() {
+	authSecret = os.Getenv("HYPERFOX_SECRET")
+}
+
+// authEnabled reports whether the auth subsystem should run at all.
+//
+// It's opt-in, not opt-out: HYPERFOX_SECRET is empty by default, so out
+// of the box this is always false and the API is exactly as open as it
+// was before this subsystem existed. Operators on a shared machine need
+// to set HYPERFOX_SECRET themselves to get any protection.
+func authEnabled() bool {
+	return authSecret != ""
+}
+
+// listenerIsLoopback records whether startServices actually bound the
+// API to a loopback-only address. requireSession/requireCSRF consult
+// this (not the client's source address) to decide whether the "skip
+// auth for local use" exemption applies: startServices binds
+// serviceBindHost ("0.0.0.0" as of this writing), so this is false in
+// the default configuration, and any other local account on the
+// machine still has to authenticate like a remote client would.
+var listenerIsLoopback bool
+
+// secretboxKey derives a fixed-size secretbox key from the configured
+// secret so operators can use a human-typable passphrase instead of
+// managing a raw 32-byte key.
+func secretboxKey() [32]byte {
+	return sha256.Sum256([]byte(authSecret))
+}
+
+type sessionPayload struct {
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// sealSession encrypts and authenticates a session payload with
+// secretbox, returning a value safe to store in a cookie.
+func sealSession(payload sessionPayload) (string, error) {
+	plaintext, err := json.Marshal(payload)
+	if err != nil {
+		return "", err
+	}
+
+	var nonce [24]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return "", err
+	}
+
+	key := secretboxKey()
+	sealed := secretbox.Seal(nonce[:], plaintext, &nonce, &key)
+
+	return base64.URLEncoding.EncodeToString(sealed), nil
+}
+
+// openSession verifies and decrypts a sealed session cookie value.
+func openSession(value string) (sessionPayload, error) {
+	var payload sessionPayload
+
+	sealed, err := base64.URLEncoding.DecodeString(value)
+	if err != nil {
+		return payload, err
+	}
+	if len(sealed) < 24 {
+		return payload, errors.New("auth: session value too short")
+	}
+
+	var nonce [24]byte
+	copy(nonce[:], sealed[:24])
+
+	key := secretboxKey()
+	plaintext, ok := secretbox.Open(nil, sealed[24:], &nonce, &key)
+	if !ok {
+		return payload, errors.New("auth: session does not authenticate")
+	}
+
+	if err := json.Unmarshal(plaintext, &payload); err != nil {
+		return payload, err
+	}
+
+	if time.Now().After(payload.ExpiresAt) {
+		return payload, errors.New("auth: session expired")
+	}
+
+	return payload, nil
+}
+
+// loginRequest is the body of a POST /login request.
+type loginRequest struct {
+	Secret string `json:"secret"`
+}
+
+// loginHandler exchanges the shared secret for a signed, expiring
+// session cookie.
+func loginHandler(w http.ResponseWriter, r *http.Request) {
+	var req loginRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		replyCode(w, http.StatusBadRequest)
+		return
+	}
+
+	if subtle.ConstantTimeCompare([]byte(req.Secret), []byte(authSecret)) != 1 {
+		replyCode(w, http.StatusUnauthorized)
+		return
+	}
+
+	value, err := sealSession(sessionPayload{ExpiresAt: time.Now().Add(sessionTTL)})
+	if err != nil {
+		log.Printf("sealSession: %q", err)
+		replyCode(w, http.StatusInternalServerError)
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    value,
+		Path:     "/",
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+		Expires:  time.Now().Add(sessionTTL),
+	})
+
+	setCSRFCookie(w)
+
+	replyCode(w, http.StatusOK)
+}
+
+// requireSession is chi middleware that rejects any request without a
+// valid session cookie. It's a no-op when the auth subsystem is
+// disabled (no secret configured) or the API is bound to a
+// loopback-only address.
+func requireSession(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !authEnabled() || listenerIsLoopback {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		cookie, err := r.Cookie(sessionCookieName)
+		if err != nil {
+			replyCode(w, http.StatusUnauthorized)
+			return
+		}
+
+		if _, err := openSession(cookie.Value); err != nil {
+			replyCode(w, http.StatusUnauthorized)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// setCSRFCookie issues a fresh per-session CSRF token readable by
+// client-side JS, per the double-submit-cookie pattern.
+func setCSRFCookie(w http.ResponseWriter) string {
+	token := make([]byte, 32)
+	_, _ = rand.Read(token)
+	value := base64.URLEncoding.EncodeToString(token)
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     csrfCookieName,
+		Value:    value,
+		Path:     "/",
+		HttpOnly: false,
+		SameSite: http.SameSiteStrictMode,
+		Expires:  time.Now().Add(sessionTTL),
+	})
+
+	return value
+}
+
+// requireCSRF is chi middleware enforcing that non-GET requests echo the
+// CSRF cookie value back in the X-CSRF-Token header. It's a no-op when
+// the auth subsystem is disabled, the API is bound to a loopback-only
+// address, or the request is read-only.
+//
+// The /dav/* mount is exempted outright rather than just GET/HEAD: it's
+// read-only (captureFS rejects every write), but real WebDAV clients
+// (mount -t davfs, Finder, Explorer) list directories with PROPFIND and
+// probe capabilities with OPTIONS, neither of which any DAV client will
+// ever decorate with an X-CSRF-Token header.
+func requireCSRF(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !authEnabled() || listenerIsLoopback || r.Method == http.MethodGet || r.Method == http.MethodHead || strings.HasPrefix(r.URL.Path, "/dav/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		cookie, err := r.Cookie(csrfCookieName)
+		if err != nil {
+			replyCode(w, http.StatusForbidden)
+			return
+		}
+
+		header := r.Header.Get(csrfHeaderName)
+		if header == "" || subtle.ConstantTimeCompare([]byte(header), []byte(cookie.Value)) != 1 {
+			replyCode(w, http.StatusForbidden)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,168 @@
+// Copyright (c) 2012-today José Nieto, https://xiam.io
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package main
+
+import (
+	"compress/gzip"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// compressibleTypes holds the content types (or prefixes ending in "/")
+// worth spending CPU to compress. Binary formats that are already
+// compressed (images, video, archives) are deliberately left out.
+var compressibleTypes = []string{
+	"text/",
+	"application/json",
+	"application/javascript",
+	"application/xml",
+	"image/svg+xml",
+}
+
+var gzipWriterPool = sync.Pool{
+	New: func() interface{} {
+		return gzip.NewWriter(nil)
+	},
+}
+
+var zstdEncoderPool = sync.Pool{
+	New: func() interface{} {
+		enc, _ := zstd.NewWriter(nil)
+		return enc
+	},
+}
+
+func isCompressibleContentType(contentType string) bool {
+	contentType = strings.ToLower(strings.TrimSpace(strings.SplitN(contentType, ";", 2)[0]))
+	for _, prefix := range compressibleTypes {
+		if strings.HasSuffix(prefix, "/") {
+			if strings.HasPrefix(contentType, prefix) {
+				return true
+			}
+			continue
+		}
+		if contentType == prefix {
+			return true
+		}
+	}
+	return false
+}
+
+// alreadyEncoded reports whether the stored body is already compressed
+// (gzip, br or zstd), per its own Content-Encoding header, so we don't
+// double-compress it.
+func alreadyEncoded(contentEncoding string) bool {
+	switch strings.ToLower(strings.TrimSpace(contentEncoding)) {
+	case "gzip", "br", "zstd":
+		return true
+	}
+	return false
+}
+
+// negotiateEncoding picks the best encoding this handler supports from
+// the client's Accept-Encoding header, preferring zstd over gzip.
+func negotiateEncoding(acceptEncoding string) string {
+	acceptEncoding = strings.ToLower(acceptEncoding)
+	if strings.Contains(acceptEncoding, "zstd") {
+		return "zstd"
+	}
+	if strings.Contains(acceptEncoding, "gzip") {
+		return "gzip"
+	}
+	return ""
+}
+
+// compressingWriter wraps an http.ResponseWriter so that writes made
+// through it are transparently gzip- or zstd-encoded, using a pooled
+// encoder to avoid per-request allocation.
+type compressingWriter struct {
+	http.ResponseWriter
+	encoding string
+	gz       *gzip.Writer
+	zs       *zstd.Encoder
+}
+
+// maybeCompress returns a writer to use for a response of the given
+// content type and content encoding: either w unchanged (when the client
+// doesn't accept compression, the content type isn't worth compressing,
+// or the body is already compressed), or a compressingWriter that must
+// have close() called once the handler is done writing.
+//
+// maybeCompress itself sets Vary and, when it compresses, also sets
+// Content-Encoding and removes Content-Length on w's headers before it
+// returns, so it must be called before the response's first write or
+// WriteHeader.
+func maybeCompress(w http.ResponseWriter, r *http.Request, contentType, contentEncoding string) (http.ResponseWriter, func()) {
+	w.Header().Add("Vary", "Accept-Encoding")
+
+	if alreadyEncoded(contentEncoding) || !isCompressibleContentType(contentType) {
+		return w, func() {}
+	}
+
+	encoding := negotiateEncoding(r.Header.Get("Accept-Encoding"))
+	if encoding == "" {
+		return w, func() {}
+	}
+
+	cw := &compressingWriter{ResponseWriter: w, encoding: encoding}
+
+	switch encoding {
+	case "zstd":
+		enc := zstdEncoderPool.Get().(*zstd.Encoder)
+		enc.Reset(w)
+		cw.zs = enc
+	case "gzip":
+		gz := gzipWriterPool.Get().(*gzip.Writer)
+		gz.Reset(w)
+		cw.gz = gz
+	}
+
+	w.Header().Set("Content-Encoding", encoding)
+	w.Header().Del("Content-Length")
+
+	return cw, func() { cw.close() }
+}
+
+func (cw *compressingWriter) Write(p []byte) (int, error) {
+	switch cw.encoding {
+	case "zstd":
+		return cw.zs.Write(p)
+	case "gzip":
+		return cw.gz.Write(p)
+	default:
+		return cw.ResponseWriter.Write(p)
+	}
+}
+
+func (cw *compressingWriter) close() {
+	switch cw.encoding {
+	case "zstd":
+		cw.zs.Close()
+		zstdEncoderPool.Put(cw.zs)
+	case "gzip":
+		cw.gz.Close()
+		gzipWriterPool.Put(cw.gz)
+	}
+}
@@ -0,0 +1,391 @@
+// Copyright (c) 2012-today José Nieto, https://xiam.io
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package main
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/go-chi/chi"
+	"github.com/malfunkt/hyperfox/pkg/plugins/capture"
+	"upper.io/db.v3"
+)
+
+const (
+	harVersion = "1.2"
+	harCreator = "hyperfox"
+	harPageref = "page_1"
+)
+
+// harLog is the top-level object of a HAR document, as defined by the
+// HAR 1.2 spec (http://www.softwareishard.com/blog/har-12-spec/).
+type harLog struct {
+	Log harLogBody `json:"log"`
+}
+
+type harLogBody struct {
+	Version string        `json:"version"`
+	Creator harCreatorObj `json:"creator"`
+	Pages   []harPage     `json:"pages,omitempty"`
+	Entries []harEntry    `json:"entries"`
+}
+
+type harCreatorObj struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type harPage struct {
+	StartedDateTime string      `json:"startedDateTime"`
+	ID              string      `json:"id"`
+	Title           string      `json:"title"`
+	PageTiming      harPageTime `json:"pageTimings"`
+}
+
+type harPageTime struct {
+	OnContentLoad float64 `json:"onContentLoad"`
+	OnLoad        float64 `json:"onLoad"`
+}
+
+type harEntry struct {
+	Pageref         string      `json:"pageref,omitempty"`
+	StartedDateTime string      `json:"startedDateTime"`
+	Time            float64     `json:"time"`
+	Request         harRequest  `json:"request"`
+	Response        harResponse `json:"response"`
+	Cache           harCache    `json:"cache"`
+	Timings         harTimings  `json:"timings"`
+}
+
+type harRequest struct {
+	Method      string      `json:"method"`
+	URL         string      `json:"url"`
+	HTTPVersion string      `json:"httpVersion"`
+	Headers     []harHeader `json:"headers"`
+	QueryString []harQuery  `json:"queryString"`
+	BodySize    int         `json:"bodySize"`
+	HeadersSize int         `json:"headersSize"`
+	PostData    *harContent `json:"postData,omitempty"`
+}
+
+type harResponse struct {
+	Status      int         `json:"status"`
+	StatusText  string      `json:"statusText"`
+	HTTPVersion string      `json:"httpVersion"`
+	Headers     []harHeader `json:"headers"`
+	Content     harContent  `json:"content"`
+	RedirectURL string      `json:"redirectURL"`
+	BodySize    int         `json:"bodySize"`
+	HeadersSize int         `json:"headersSize"`
+}
+
+type harHeader struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type harQuery struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type harContent struct {
+	Size     int    `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text,omitempty"`
+	Encoding string `json:"encoding,omitempty"`
+}
+
+// isTextContentType reports whether a Content-Type is safe to embed in a
+// HAR document as a plain (UTF-8) JSON string, assuming the body isn't
+// itself encoded (see alreadyEncoded). Anything else (images, fonts,
+// protobuf, etc.) must go through harContentOf's base64 path instead, or
+// json.Marshal will silently replace invalid byte sequences with U+FFFD
+// and corrupt the body.
+func isTextContentType(mimeType string) bool {
+	mimeType = strings.ToLower(strings.TrimSpace(mimeType))
+	if strings.HasPrefix(mimeType, "text/") {
+		return true
+	}
+	for _, substr := range []string{"json", "xml", "javascript", "x-www-form-urlencoded"} {
+		if strings.Contains(mimeType, substr) {
+			return true
+		}
+	}
+	return false
+}
+
+// harContentOf builds a harContent for body, base64-encoding it (and
+// setting Encoding per the HAR 1.2 spec) unless mimeType is known to be
+// text and contentEncoding says the body isn't itself still
+// gzip/br/zstd-compressed, so non-UTF-8 payloads round-trip intact
+// instead of being corrupted by json.Marshal. contentEncoding is the
+// record's own Content-Encoding header value; alreadyEncoded (compress.go)
+// is the same check maybeCompress uses to decide whether a stored body is
+// already compressed.
+func harContentOf(mimeType, contentEncoding string, body []byte) harContent {
+	c := harContent{Size: len(body), MimeType: mimeType}
+	if isTextContentType(mimeType) && !alreadyEncoded(contentEncoding) {
+		c.Text = string(body)
+	} else {
+		c.Text = base64.StdEncoding.EncodeToString(body)
+		c.Encoding = "base64"
+	}
+	return c
+}
+
+type harCache struct{}
+
+type harTimings struct {
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+}
+
+func harHeaders(h http.Header) []harHeader {
+	headers := make([]harHeader, 0, len(h))
+	for name, values := range h {
+		for _, v := range values {
+			headers = append(headers, harHeader{Name: name, Value: v})
+		}
+	}
+	return headers
+}
+
+func harHeadersSize(h http.Header) int {
+	size := 0
+	for name, values := range h {
+		for _, v := range values {
+			size += len(name) + len(v) + 4 // ": " + "\r\n"
+		}
+	}
+	return size
+}
+
+func harQueryString(rawURL string) []harQuery {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil
+	}
+	var queries []harQuery
+	for name, values := range u.Query() {
+		for _, v := range values {
+			queries = append(queries, harQuery{Name: name, Value: v})
+		}
+	}
+	return queries
+}
+
+// recordToHAREntry converts a fully-loaded capture.Record (headers and
+// bodies already decoded, as returned by getCaptureRecord) into a HAR
+// entry.
+func recordToHAREntry(record *capture.Record) harEntry {
+	reqContentType := record.RequestHeader.Header.Get("Content-Type")
+	reqContentEncoding := record.RequestHeader.Header.Get("Content-Encoding")
+	respContentType := record.Header.Header.Get("Content-Type")
+	respContentEncoding := record.Header.Header.Get("Content-Encoding")
+
+	entry := harEntry{
+		Pageref:         harPageref,
+		StartedDateTime: record.DateStart.Format("2006-01-02T15:04:05.000Z07:00"),
+		Time:            float64(record.TimeTaken) / 1e6,
+		Request: harRequest{
+			Method:      record.Method,
+			URL:         record.URL,
+			HTTPVersion: "HTTP/1.1",
+			Headers:     harHeaders(record.RequestHeader.Header),
+			QueryString: harQueryString(record.URL),
+			BodySize:    len(record.RequestBody),
+			HeadersSize: harHeadersSize(record.RequestHeader.Header),
+		},
+		Response: harResponse{
+			Status:      record.Status,
+			StatusText:  http.StatusText(record.Status),
+			HTTPVersion: "HTTP/1.1",
+			Headers:     harHeaders(record.Header.Header),
+			Content:     harContentOf(respContentType, respContentEncoding, record.Body),
+			BodySize:    len(record.Body),
+			HeadersSize: harHeadersSize(record.Header.Header),
+		},
+		Timings: harTimings{
+			Send:    0,
+			Wait:    float64(record.TimeTaken) / 1e6,
+			Receive: 0,
+		},
+	}
+
+	if len(record.RequestBody) > 0 {
+		content := harContentOf(reqContentType, reqContentEncoding, record.RequestBody)
+		entry.Request.PostData = &content
+	}
+
+	return entry
+}
+
+// harEncoder writes a harLog to w incrementally: the envelope and each
+// entry are written as they're produced, so a bulk export never needs to
+// hold the whole HAR document in memory.
+type harEncoder struct {
+	w     http.ResponseWriter
+	wrote bool
+}
+
+func newHAREncoder(w http.ResponseWriter) *harEncoder {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", `attachment; filename="capture.har"`)
+
+	_, _ = w.Write([]byte(`{"log":{"version":"` + harVersion + `","creator":{"name":"` + harCreator + `","version":"1"},"entries":[`))
+
+	return &harEncoder{w: w}
+}
+
+func (h *harEncoder) writeEntry(entry harEntry) error {
+	if h.wrote {
+		if _, err := h.w.Write([]byte(",")); err != nil {
+			return err
+		}
+	}
+	h.wrote = true
+
+	buf, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	_, err = h.w.Write(buf)
+	if flusher, ok := h.w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+	return err
+}
+
+func (h *harEncoder) close() {
+	_, _ = h.w.Write([]byte(`]}}`))
+}
+
+// recordHAREntryHandler exports a single capture.Record as a standalone
+// HAR document.
+func recordHAREntryHandler(w http.ResponseWriter, r *http.Request) {
+	uuid := chi.URLParam(r, "uuid")
+
+	record, err := getCaptureRecord(uuid)
+	if err != nil {
+		log.Printf("getCaptureRecord: %q", err)
+		replyCode(w, http.StatusInternalServerError)
+		return
+	}
+
+	doc := harLog{Log: harLogBody{
+		Version: harVersion,
+		Creator: harCreatorObj{Name: harCreator, Version: "1"},
+		Entries: []harEntry{recordToHAREntry(record)},
+	}}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(doc); err != nil {
+		log.Printf("Encode: %q", err)
+	}
+}
+
+// capturesHARHandler streams every capture.Record matching the "q"
+// filter (same syntax as capturesHandler) as a single HAR document,
+// writing entries directly to w as they're read from storage so
+// multi-GB captures never need to be held in memory at once.
+func capturesHARHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query().Get("q")
+	q = reUnsafeChars.ReplaceAllString(q, " ")
+	q = reRepeatedBlank.ReplaceAllString(q, " ")
+
+	res := storage.Find().OrderBy("id").Select(
+		"uuid",
+		"origin",
+		"method",
+		"status",
+		"content_type",
+		"content_length",
+		"host",
+		"url",
+		"path",
+		"scheme",
+		"date_start",
+		"date_end",
+		"time_taken",
+		"header",
+		"request_header",
+		db.Raw("hex(body) AS body"),
+		db.Raw("hex(request_body) AS request_body"),
+	)
+
+	if q != "" {
+		terms := strings.Split(q, " ")
+		conds := db.Or()
+		for _, term := range terms {
+			conds = conds.Or(
+				db.Or(
+					db.Cond{"host LIKE": "%" + term + "%"},
+					db.Cond{"origin LIKE": "%" + term + "%"},
+					db.Cond{"path LIKE": "%" + term + "%"},
+					db.Cond{"content_type LIKE": "%" + term + "%"},
+					db.Cond{"method": term},
+					db.Cond{"scheme": term},
+					db.Cond{"status": term},
+				),
+			)
+		}
+		res = res.Where(conds)
+	}
+
+	defer res.Close()
+
+	enc := newHAREncoder(w)
+	defer enc.close()
+
+	var record capture.Record
+	for res.Next(&record) {
+		requestBody, err := hex.DecodeString(string(record.RequestBody))
+		if err != nil {
+			log.Printf("hex.DecodeString: %q", err)
+			continue
+		}
+		record.RequestBody = requestBody
+
+		body, err := hex.DecodeString(string(record.Body))
+		if err != nil {
+			log.Printf("hex.DecodeString: %q", err)
+			continue
+		}
+		record.Body = body
+
+		if err := enc.writeEntry(recordToHAREntry(&record)); err != nil {
+			log.Printf("writeEntry: %q", err)
+			return
+		}
+	}
+
+	if err := res.Err(); err != nil {
+		log.Printf("res.Err: %q", err)
+	}
+}
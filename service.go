@@ -142,8 +142,21 @@ func replyBinary(w http.ResponseWriter, r *http.Request, record *capture.Record,
 				"Content-Type",
 				embedContentType,
 			)
-			w.Write(buf.Bytes())
+
+			var recordContentEncoding string
+			if optResponseBody {
+				recordContentEncoding = record.Header.Header.Get("Content-Encoding")
+			} else {
+				recordContentEncoding = record.RequestHeader.Header.Get("Content-Encoding")
+			}
+
+			cw, closeCW := maybeCompress(w, r, embedContentType, recordContentEncoding)
+			cw.Write(buf.Bytes())
+			closeCW()
 		} else {
+			// http.ServeContent needs to see the uncompressed length to
+			// serve Range requests correctly, so the downloadable/raw
+			// path is intentionally left uncompressed.
 			w.Header().Set(
 				"Content-Disposition",
 				fmt.Sprintf(`attachment; filename="%s"`, basename),
@@ -154,7 +167,7 @@ func replyBinary(w http.ResponseWriter, r *http.Request, record *capture.Record,
 
 }
 
-func replyJSON(w http.ResponseWriter, data interface{}) {
+func replyJSON(w http.ResponseWriter, r *http.Request, data interface{}) {
 	var buf []byte
 	var err error
 
@@ -167,8 +180,11 @@ func replyJSON(w http.ResponseWriter, data interface{}) {
 	w.Header().Set("Access-Control-Allow-Origin", "*")
 	w.Header().Set("Content-Type", "application/json")
 
+	cw, closeCW := maybeCompress(w, r, "application/json", "")
+	defer closeCW()
+
 	w.WriteHeader(http.StatusOK)
-	_, _ = w.Write(buf)
+	_, _ = cw.Write(buf)
 }
 
 func getCaptureRecord(uuid string) (*capture.Record, error) {
@@ -229,7 +245,7 @@ func recordMetaHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	replyJSON(w, record.RecordMeta)
+	replyJSON(w, r, record.RecordMeta)
 }
 
 func recordHandler(w http.ResponseWriter, r *http.Request, opts writeOption) {
@@ -269,30 +285,13 @@ func responseEmbedHandler(w http.ResponseWriter, r *http.Request) {
 	recordHandler(w, r, writeResponseBody|writeEmbed)
 }
 
-// capturesHandler service serves paginated requests.
-func capturesHandler(w http.ResponseWriter, r *http.Request) {
-	var err error
-	var response pullResponse
-
-	q := chi.URLParam(r, "q")
-
+// capturesQuery builds the db.Result for the "q" filter shared by every
+// capturesHandler mode (paged JSON, NDJSON, cursor).
+func capturesQuery(q string) db.Result {
 	q = reUnsafeChars.ReplaceAllString(q, " ")
 	q = reRepeatedBlank.ReplaceAllString(q, " ")
 
-	{
-		page, err := strconv.ParseUint(chi.URLParam(r, "page"), 10, 64)
-		if err == nil {
-			response.Page = uint(page)
-		}
-	}
-	if response.Page < 1 {
-		response.Page = 1
-	}
-
-	// Result set
-	res := storage.Find().OrderBy("id").
-		Limit(pageSize).
-		Offset(pageSize * int(response.Page-1))
+	res := storage.Find().OrderBy("id")
 
 	if q != "" {
 		terms := strings.Split(q, " ")
@@ -315,6 +314,49 @@ func capturesHandler(w http.ResponseWriter, r *http.Request) {
 		res = res.Where(conds)
 	}
 
+	return res
+}
+
+// capturesHandler service serves paginated requests. Three modes are
+// supported:
+//
+//   - default: offset pagination, whole page marshaled as JSON (backward
+//     compatible behavior).
+//   - Accept: application/x-ndjson: streams one capture.RecordMeta per
+//     line as rows are read, instead of buffering the page in memory.
+//   - ?after_id=<id>&limit=N: cursor pagination. Replaces Offset with a
+//     "WHERE id > ?" predicate and skips COUNT(*) entirely, so it stays
+//     fast regardless of how deep into the capture DB the cursor is.
+func capturesHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query().Get("q")
+
+	if afterID := r.URL.Query().Get("after_id"); afterID != "" {
+		capturesCursorHandler(w, r, q, afterID)
+		return
+	}
+
+	if acceptsNDJSON(r) {
+		capturesNDJSONHandler(w, r, q)
+		return
+	}
+
+	var err error
+	var response pullResponse
+
+	{
+		page, err := strconv.ParseUint(r.URL.Query().Get("page"), 10, 64)
+		if err == nil {
+			response.Page = uint(page)
+		}
+	}
+	if response.Page < 1 {
+		response.Page = 1
+	}
+
+	res := capturesQuery(q).
+		Limit(pageSize).
+		Offset(pageSize * int(response.Page-1))
+
 	// Pulling information page.
 	if err = res.All(&response.Requests); err != nil {
 		log.Printf("res.All: %q", err)
@@ -327,7 +369,90 @@ func capturesHandler(w http.ResponseWriter, r *http.Request) {
 		response.Pages = uint(math.Ceil(float64(c) / float64(pageSize)))
 	}
 
-	replyJSON(w, response)
+	replyJSON(w, r, response)
+}
+
+func acceptsNDJSON(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "application/x-ndjson")
+}
+
+// capturesNDJSONHandler writes one capture.RecordMeta JSON object per
+// line, flushing after each so a client sees rows as they're read from
+// storage instead of waiting for the whole page.
+func capturesNDJSONHandler(w http.ResponseWriter, r *http.Request, q string) {
+	res := capturesQuery(q).Limit(pageSize)
+
+	if page, err := strconv.ParseUint(r.URL.Query().Get("page"), 10, 64); err == nil && page > 0 {
+		res = res.Offset(pageSize * int(page-1))
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	flusher, _ := w.(http.Flusher)
+
+	enc := json.NewEncoder(w)
+
+	var rec capture.RecordMeta
+	for res.Next(&rec) {
+		if err := enc.Encode(rec); err != nil {
+			log.Printf("Encode: %q", err)
+			return
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+
+	if err := res.Err(); err != nil {
+		log.Printf("res.Err: %q", err)
+	}
+}
+
+// capturesCursorHandler serves "WHERE id > after_id" pages. It never
+// issues COUNT(*), and returns the id of the last row written in the
+// X-Next-Cursor header so the client can request the following page
+// without an offset.
+func capturesCursorHandler(w http.ResponseWriter, r *http.Request, q, afterID string) {
+	id, err := strconv.ParseUint(afterID, 10, 64)
+	if err != nil {
+		replyCode(w, http.StatusBadRequest)
+		return
+	}
+
+	limit := pageSize
+	if l, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && l > 0 {
+		limit = l
+	}
+
+	res := capturesQuery(q).Where(db.Cond{"id >": id}).Limit(limit)
+
+	var records []capture.RecordMeta
+	if err := res.All(&records); err != nil {
+		log.Printf("res.All: %q", err)
+		replyCode(w, http.StatusInternalServerError)
+		return
+	}
+
+	if len(records) > 0 {
+		w.Header().Set("X-Next-Cursor", strconv.FormatUint(uint64(records[len(records)-1].ID), 10))
+	}
+
+	if acceptsNDJSON(r) {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		flusher, _ := w.(http.Flusher)
+		enc := json.NewEncoder(w)
+		for _, rec := range records {
+			if err := enc.Encode(rec); err != nil {
+				log.Printf("Encode: %q", err)
+				return
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+		return
+	}
+
+	replyJSON(w, r, pullResponse{Requests: records})
 }
 
 // startServices starts an http server that provides websocket and rest
@@ -337,27 +462,43 @@ func startServices() error {
 	r := chi.NewRouter()
 	r.Use(middleware.Logger)
 
-	r.Route("/records", func(r chi.Router) {
-		r.Get("/", capturesHandler)
+	// /login is the only route that must be reachable without a session,
+	// so it's kept outside the authenticated group below rather than
+	// relying on registration order on the root mux (chi.Mux.Use panics
+	// once routes have already been registered on it).
+	r.Post("/login", loginHandler)
 
-		r.Route("/{uuid}", func(r chi.Router) {
-			r.Get("/", recordMetaHandler)
+	r.Group(func(r chi.Router) {
+		r.Use(requireSession)
+		r.Use(requireCSRF)
 
-			r.Route("/request", func(r chi.Router) {
-				r.Get("/", requestContentHandler)
-				r.Get("/raw", requestWireHandler)
-				r.Get("/embed", requestEmbedHandler)
-			})
+		r.Get("/records.har", capturesHARHandler)
+
+		r.Route("/records", func(r chi.Router) {
+			r.Get("/", capturesHandler)
+			r.Get("/{uuid}.har", recordHAREntryHandler)
+
+			r.Route("/{uuid}", func(r chi.Router) {
+				r.Get("/", recordMetaHandler)
+
+				r.Route("/request", func(r chi.Router) {
+					r.Get("/", requestContentHandler)
+					r.Get("/raw", requestWireHandler)
+					r.Get("/embed", requestEmbedHandler)
+				})
 
-			r.Route("/response", func(r chi.Router) {
-				r.Get("/", responseContentHandler)
-				r.Get("/raw", responseWireHandler)
-				r.Get("/embed", responseEmbedHandler)
+				r.Route("/response", func(r chi.Router) {
+					r.Get("/", responseContentHandler)
+					r.Get("/raw", responseWireHandler)
+					r.Get("/embed", responseEmbedHandler)
+				})
 			})
 		})
-	})
 
-	//r.HandleFunc("/ws", wsHandler)
+		r.HandleFunc("/ws", wsHandler)
+
+		r.Handle("/dav/*", davHandler)
+	})
 
 	log.Printf("Starting (local) API server...")
 
@@ -367,6 +508,11 @@ func startServices() error {
 		log.Fatal("net.Listen: ", err)
 	}
 
+	// requireSession/requireCSRF key their "local use" exemption off this,
+	// not off a client's claimed remote address, so it has to reflect what
+	// we actually bound rather than the request that happens to arrive.
+	listenerIsLoopback = ln.Addr().(*net.TCPAddr).IP.IsLoopback()
+
 	addr := fmt.Sprintf("%s:%d", serviceBindHost, ln.Addr().(*net.TCPAddr).Port)
 	log.Printf("Watch live capture at http://live.hyperfox.org/#/?source=%s", addr)
 
@@ -382,5 +528,7 @@ func startServices() error {
 		}
 	}()
 
+	go capturePoller(wsPollInterval)
+
 	return err
 }
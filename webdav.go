@@ -0,0 +1,334 @@
+// Copyright (c) 2012-today José Nieto, https://xiam.io
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/malfunkt/hyperfox/pkg/plugins/capture"
+	"golang.org/x/net/webdav"
+	"upper.io/db.v3"
+)
+
+// captureFS is a read-only webdav.FileSystem backed by storage. It
+// presents captures as:
+//
+//	/<host>/<YYYY-MM-DD>/<METHOD>-<path>-<uuid>.req
+//	/<host>/<YYYY-MM-DD>/<METHOD>-<path>-<uuid>.resp
+//
+// where <uuid> is the short suffix davRecordBasename appends, so the
+// capture database can be mounted with `mount -t davfs` or
+// browsed from Finder/Explorer without a dedicated client.
+type captureFS struct{}
+
+func (captureFS) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	return os.ErrPermission
+}
+
+func (captureFS) RemoveAll(ctx context.Context, name string) error {
+	return os.ErrPermission
+}
+
+func (captureFS) Rename(ctx context.Context, oldName, newName string) error {
+	return os.ErrPermission
+}
+
+func (captureFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE) != 0 {
+		return nil, os.ErrPermission
+	}
+
+	name = strings.Trim(name, "/")
+	if name == "" {
+		return newDirFile(davRootEntries()), nil
+	}
+
+	parts := strings.SplitN(name, "/", 3)
+
+	switch len(parts) {
+	case 1:
+		return newDirFile(davHostEntries(parts[0])), nil
+	case 2:
+		return newDirFile(davDateEntries(parts[0], parts[1])), nil
+	case 3:
+		return openDavRecordFile(parts[0], parts[1], parts[2])
+	}
+
+	return nil, os.ErrNotExist
+}
+
+func (fs captureFS) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	f, err := fs.OpenFile(ctx, name, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return f.Stat()
+}
+
+// davFileInfo is a static os.FileInfo, used for both directories and
+// (once sized) capture files.
+type davFileInfo struct {
+	name    string
+	size    int64
+	isDir   bool
+	modTime time.Time
+}
+
+func (fi davFileInfo) Name() string       { return fi.name }
+func (fi davFileInfo) Size() int64        { return fi.size }
+func (fi davFileInfo) Mode() os.FileMode {
+	if fi.isDir {
+		return os.ModeDir | 0555
+	}
+	return 0444
+}
+func (fi davFileInfo) ModTime() time.Time { return fi.modTime }
+func (fi davFileInfo) IsDir() bool        { return fi.isDir }
+func (fi davFileInfo) Sys() interface{}   { return nil }
+
+// dirFile is a webdav.File listing a fixed, pre-computed set of
+// directory entries; Read always fails since directories have no bytes
+// of their own.
+type dirFile struct {
+	info    davFileInfo
+	entries []os.FileInfo
+}
+
+func newDirFile(entries []os.FileInfo) *dirFile {
+	return &dirFile{
+		info:    davFileInfo{name: "", isDir: true, modTime: time.Now()},
+		entries: entries,
+	}
+}
+
+func (f *dirFile) Close() error               { return nil }
+func (f *dirFile) Read(p []byte) (int, error) { return 0, io.EOF }
+func (f *dirFile) Seek(offset int64, whence int) (int64, error) { return 0, nil }
+func (f *dirFile) Write(p []byte) (int, error) { return 0, os.ErrPermission }
+func (f *dirFile) Stat() (os.FileInfo, error) { return f.info, nil }
+
+func (f *dirFile) Readdir(count int) ([]os.FileInfo, error) {
+	if count <= 0 || count > len(f.entries) {
+		entries := f.entries
+		f.entries = nil
+		return entries, nil
+	}
+	entries := f.entries[:count]
+	f.entries = f.entries[count:]
+	return entries, nil
+}
+
+// recordFile is a read-only, seekable view over a decoded request or
+// response body.
+type recordFile struct {
+	info   davFileInfo
+	reader *bytes.Reader
+}
+
+func (f *recordFile) Close() error { return nil }
+func (f *recordFile) Read(p []byte) (int, error) { return f.reader.Read(p) }
+func (f *recordFile) Seek(offset int64, whence int) (int64, error) {
+	return f.reader.Seek(offset, whence)
+}
+func (f *recordFile) Write(p []byte) (int, error) { return 0, os.ErrPermission }
+func (f *recordFile) Stat() (os.FileInfo, error)  { return f.info, nil }
+func (f *recordFile) Readdir(count int) ([]os.FileInfo, error) {
+	return nil, os.ErrInvalid
+}
+
+// davRootEntries lists the distinct hosts that have captures.
+func davRootEntries() []os.FileInfo {
+	var hosts []string
+	res := storage.Find().Select(db.Raw("DISTINCT host")).OrderBy("host")
+	if err := res.All(&hosts); err != nil {
+		return nil
+	}
+
+	entries := make([]os.FileInfo, 0, len(hosts))
+	for _, host := range hosts {
+		entries = append(entries, davFileInfo{name: host, isDir: true, modTime: time.Now()})
+	}
+	return entries
+}
+
+// davHostEntries lists the distinct capture dates (YYYY-MM-DD) for host.
+func davHostEntries(host string) []os.FileInfo {
+	var dates []string
+	res := storage.Find(db.Cond{"host": host}).
+		Select(db.Raw(`DISTINCT strftime('%Y-%m-%d', date_start) AS date_start`)).
+		OrderBy("date_start")
+	if err := res.All(&dates); err != nil {
+		return nil
+	}
+
+	entries := make([]os.FileInfo, 0, len(dates))
+	for _, date := range dates {
+		entries = append(entries, davFileInfo{name: date, isDir: true, modTime: time.Now()})
+	}
+	return entries
+}
+
+// davRecordsOn returns every capture.RecordMeta for host whose date_start
+// falls on date (YYYY-MM-DD), paging over storage.Find in pageSize chunks
+// until exhausted so hosts/dates with more than one page of captures
+// aren't silently truncated.
+//
+// The date condition goes through db.Cond (like every other query in this
+// file) instead of splicing date into a raw SQL fragment, since date is
+// attacker-controlled (it comes straight off the WebDAV request path).
+func davRecordsOn(host, date string) ([]capture.RecordMeta, error) {
+	var metas []capture.RecordMeta
+	for offset := 0; ; offset += pageSize {
+		var page []capture.RecordMeta
+		res := storage.Find(
+			db.Cond{"host": host},
+			db.Cond{"date_start LIKE": date + "%"},
+		).OrderBy("id").Limit(pageSize).Offset(offset)
+		if err := res.All(&page); err != nil {
+			return nil, err
+		}
+		metas = append(metas, page...)
+		if len(page) < pageSize {
+			return metas, nil
+		}
+	}
+}
+
+// davDateEntries lists the .req/.resp files for every capture on host at
+// the given date.
+func davDateEntries(host, date string) []os.FileInfo {
+	metas, err := davRecordsOn(host, date)
+	if err != nil {
+		return nil
+	}
+
+	entries := make([]os.FileInfo, 0, len(metas)*2)
+	for _, meta := range metas {
+		base := davRecordBasename(meta)
+		entries = append(entries,
+			davFileInfo{name: base + ".req", size: int64(meta.ContentLength), modTime: meta.DateEnd},
+			davFileInfo{name: base + ".resp", size: int64(meta.ContentLength), modTime: meta.DateEnd},
+		)
+	}
+	return entries
+}
+
+// davRecordBasename builds the .req/.resp basename for meta. Two captures
+// to the same host/path/date (the normal case for repeated API hits)
+// would otherwise produce identical basenames, hiding every collision
+// past the first from both directory listings and openDavRecordFile, so
+// a short UUID suffix is always appended to disambiguate.
+func davRecordBasename(meta capture.RecordMeta) string {
+	base := meta.Method + "-" + meta.Path
+	base = reUnsafeFile.ReplaceAllString(base, "-")
+	base = strings.Trim(reRepeatedDash.ReplaceAllString(base, "-"), "-")
+	if base == "" {
+		base = "record"
+	}
+	return base + "-" + davUUIDSuffix(meta.UUID)
+}
+
+// davUUIDSuffix returns a short, filename-safe disambiguator derived from
+// a capture's UUID.
+func davUUIDSuffix(uuid string) string {
+	uuid = reUnsafeFile.ReplaceAllString(uuid, "")
+	if len(uuid) > 8 {
+		return uuid[:8]
+	}
+	return uuid
+}
+
+// openDavRecordFile resolves a "<method>-<path>-<uuid>.req"/".resp" leaf back
+// to a capture.Record and returns a seekable view over the appropriate
+// body.
+func openDavRecordFile(host, date, leaf string) (webdav.File, error) {
+	var isRequest bool
+	switch {
+	case strings.HasSuffix(leaf, ".req"):
+		isRequest = true
+		leaf = strings.TrimSuffix(leaf, ".req")
+	case strings.HasSuffix(leaf, ".resp"):
+		leaf = strings.TrimSuffix(leaf, ".resp")
+	default:
+		return nil, os.ErrNotExist
+	}
+
+	metas, err := davRecordsOn(host, date)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, meta := range metas {
+		if davRecordBasename(meta) != leaf {
+			continue
+		}
+
+		record, err := getCaptureRecord(meta.UUID)
+		if err != nil {
+			return nil, err
+		}
+
+		body := record.Body
+		if isRequest {
+			body = record.RequestBody
+		}
+
+		name := leaf + ".resp"
+		if isRequest {
+			name = leaf + ".req"
+		}
+
+		return &recordFile{
+			info:   davFileInfo{name: name, size: int64(len(body)), modTime: record.DateEnd},
+			reader: bytes.NewReader(body),
+		}, nil
+	}
+
+	return nil, os.ErrNotExist
+}
+
+// davLockSystem is a no-op lock system: the mount is read-only, so there
+// is nothing to serialize writes against.
+type davLockSystem struct{}
+
+func (davLockSystem) Confirm(now time.Time, name0, name1 string, conditions ...webdav.Condition) (func(), error) {
+	return func() {}, nil
+}
+func (davLockSystem) Create(now time.Time, details webdav.LockDetails) (string, error) {
+	return "", webdav.ErrNotImplemented
+}
+func (davLockSystem) Refresh(now time.Time, token string, duration time.Duration) (webdav.LockDetails, error) {
+	return webdav.LockDetails{}, webdav.ErrNotImplemented
+}
+func (davLockSystem) Unlock(now time.Time, token string) error { return webdav.ErrNotImplemented }
+
+var davHandler = &webdav.Handler{
+	Prefix:     "/dav",
+	FileSystem: captureFS{},
+	LockSystem: davLockSystem{},
+}
@@ -0,0 +1,324 @@
+// Copyright (c) 2012-today José Nieto, https://xiam.io
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package main
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/malfunkt/hyperfox/pkg/plugins/capture"
+	"upper.io/db.v3"
+)
+
+const (
+	wsRingBufferSize = 512
+
+	wsWriteWait      = 10 * time.Second
+	wsPongWait       = 60 * time.Second
+	wsPingPeriod     = (wsPongWait * 9) / 10
+	wsSubscriberSize = 32
+
+	// wsPollInterval is how often capturePoller checks storage for rows
+	// written since the last poll. See publishCapture's doc comment for why
+	// polling, rather than a hook into the write path, is what actually
+	// drives /ws in this tree.
+	wsPollInterval = 250 * time.Millisecond
+)
+
+var wsUpgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+	CheckOrigin:     func(r *http.Request) bool { return true },
+}
+
+// captureHub fans captured records out to every connected websocket
+// subscriber, applying each subscriber's own filter and dropping
+// subscribers that can't keep up instead of blocking on them.
+type captureHub struct {
+	mu          sync.Mutex
+	subscribers map[*wsSubscriber]struct{}
+	ring        []capture.RecordMeta
+	ringNext    int
+	ringFull    bool
+}
+
+var hub = newCaptureHub()
+
+func newCaptureHub() *captureHub {
+	return &captureHub{
+		subscribers: make(map[*wsSubscriber]struct{}),
+		ring:        make([]capture.RecordMeta, wsRingBufferSize),
+	}
+}
+
+// wsSubscriber is a single connected client with its own filter and send
+// queue.
+type wsSubscriber struct {
+	conn   *websocket.Conn
+	send   chan capture.RecordMeta
+	filter []string
+}
+
+func (h *captureHub) subscribe(conn *websocket.Conn, q string) *wsSubscriber {
+	sub := &wsSubscriber{
+		conn:   conn,
+		send:   make(chan capture.RecordMeta, wsSubscriberSize),
+		filter: splitQueryTerms(q),
+	}
+
+	h.mu.Lock()
+	h.subscribers[sub] = struct{}{}
+	h.mu.Unlock()
+
+	return sub
+}
+
+func (h *captureHub) unsubscribe(sub *wsSubscriber) {
+	h.mu.Lock()
+	if _, ok := h.subscribers[sub]; ok {
+		delete(h.subscribers, sub)
+		close(sub.send)
+	}
+	h.mu.Unlock()
+}
+
+// publish stores rec in the ring buffer and pushes it to every subscriber
+// whose filter matches. A subscriber whose send queue is full is dropped
+// rather than allowed to block the hub.
+func (h *captureHub) publish(rec capture.RecordMeta) {
+	h.mu.Lock()
+	h.ring[h.ringNext] = rec
+	h.ringNext = (h.ringNext + 1) % len(h.ring)
+	if h.ringNext == 0 {
+		h.ringFull = true
+	}
+
+	for sub := range h.subscribers {
+		if !recordMetaMatches(rec, sub.filter) {
+			continue
+		}
+		select {
+		case sub.send <- rec:
+		default:
+			log.Printf("ws: subscriber too slow, dropping")
+			delete(h.subscribers, sub)
+			close(sub.send)
+		}
+	}
+	h.mu.Unlock()
+}
+
+// since returns the records published after the one with the given uuid,
+// oldest first. If uuid is empty or not found in the ring buffer, since
+// returns all buffered records.
+func (h *captureHub) since(uuid string) []capture.RecordMeta {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	ordered := make([]capture.RecordMeta, 0, len(h.ring))
+	if h.ringFull {
+		ordered = append(ordered, h.ring[h.ringNext:]...)
+	}
+	ordered = append(ordered, h.ring[:h.ringNext]...)
+
+	if uuid == "" {
+		return ordered
+	}
+
+	for i, rec := range ordered {
+		if rec.UUID == uuid {
+			return ordered[i+1:]
+		}
+	}
+
+	return ordered
+}
+
+// splitQueryTerms mirrors capturesHandler's "q" parameter parsing so the
+// same filter syntax works for both polling and streaming clients.
+func splitQueryTerms(q string) []string {
+	q = reUnsafeChars.ReplaceAllString(q, " ")
+	q = reRepeatedBlank.ReplaceAllString(q, " ")
+	q = strings.TrimSpace(q)
+	if q == "" {
+		return nil
+	}
+	return strings.Split(q, " ")
+}
+
+// recordMetaMatches reports whether rec matches any one of terms (or terms
+// is empty), using the same fields and semantics as capturesHandler's SQL
+// filter.
+func recordMetaMatches(rec capture.RecordMeta, terms []string) bool {
+	if len(terms) == 0 {
+		return true
+	}
+	for _, term := range terms {
+		lower := strings.ToLower(term)
+		if strings.Contains(strings.ToLower(rec.Host), lower) ||
+			strings.Contains(strings.ToLower(rec.Origin), lower) ||
+			strings.Contains(strings.ToLower(rec.Path), lower) ||
+			strings.Contains(strings.ToLower(rec.ContentType), lower) ||
+			strings.EqualFold(rec.Method, term) ||
+			strings.EqualFold(rec.Scheme, term) ||
+			strconv.Itoa(rec.Status) == term {
+			return true
+		}
+	}
+	return false
+}
+
+// wsHandler upgrades the connection and streams capture.RecordMeta frames
+// to the client as they're persisted. The "q" query parameter filters the
+// stream server-side using the same syntax as capturesHandler. A client
+// reconnecting after a drop can pass "since" with the last UUID it saw to
+// backfill from the hub's ring buffer before live events resume.
+func wsHandler(w http.ResponseWriter, r *http.Request) {
+	conn, err := wsUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Printf("wsUpgrader.Upgrade: %q", err)
+		return
+	}
+
+	sub := hub.subscribe(conn, r.URL.Query().Get("q"))
+	defer hub.unsubscribe(sub)
+
+	for _, rec := range hub.since(r.URL.Query().Get("since")) {
+		if recordMetaMatches(rec, sub.filter) {
+			conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			if err := conn.WriteJSON(rec); err != nil {
+				conn.Close()
+				return
+			}
+		}
+	}
+
+	go wsReadLoop(conn)
+	wsWriteLoop(conn, sub)
+}
+
+// wsReadLoop discards client frames but keeps the read deadline alive so
+// pong keepalives are observed; it returns (closing the connection) once
+// the peer goes away.
+func wsReadLoop(conn *websocket.Conn) {
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	conn.SetPongHandler(func(string) error {
+		conn.SetReadDeadline(time.Now().Add(wsPongWait))
+		return nil
+	})
+
+	for {
+		if _, _, err := conn.NextReader(); err != nil {
+			return
+		}
+	}
+}
+
+// wsWriteLoop pushes queued records to the client and sends periodic
+// pings, exiting (and closing the connection) when the subscriber is
+// dropped or the connection dies.
+func wsWriteLoop(conn *websocket.Conn, sub *wsSubscriber) {
+	ticker := time.NewTicker(wsPingPeriod)
+	defer func() {
+		ticker.Stop()
+		conn.Close()
+	}()
+
+	for {
+		select {
+		case rec, ok := <-sub.send:
+			conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			if !ok {
+				conn.WriteMessage(websocket.CloseMessage, []byte{})
+				return
+			}
+			if err := conn.WriteJSON(rec); err != nil {
+				return
+			}
+		case <-ticker.C:
+			conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			if err := conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// publishCapture pushes rec to the hub, so it only ever advertises
+// records a client could also retrieve via capturesHandler.
+//
+// The proxy/capture-plugin code that writes records to storage (no
+// main.go or pkg/plugins/capture is present in this tree) isn't
+// reachable from here to hook directly, so capturePoller below is what
+// actually drives this: it notices newly-inserted rows by polling
+// storage itself and calls this for each one. If the write path ever
+// becomes reachable from this package, calling this directly from
+// immediately after the insert succeeds would let capturePoller be
+// retired in favor of push-based delivery with no polling lag.
+func publishCapture(rec capture.RecordMeta) {
+	hub.publish(rec)
+}
+
+// capturePoller is what actually makes /ws stream live: it polls
+// storage every wsPollInterval for rows with id greater than the
+// highest one it's already published, in the same ascending-by-id order
+// capturesCursorHandler relies on for its cursor semantics, and feeds
+// each one to publishCapture. It starts from the current maximum id so
+// a freshly (re)started server doesn't replay the entire capture
+// history as a burst of "live" events.
+func capturePoller(interval time.Duration) {
+	var lastID uint64
+
+	{
+		var newest capture.RecordMeta
+		res := storage.Find().OrderBy("-id").Limit(1)
+		if err := res.One(&newest); err == nil {
+			lastID = uint64(newest.ID)
+		}
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		var recs []capture.RecordMeta
+		res := storage.Find(db.Cond{"id >": lastID}).OrderBy("id")
+		if err := res.All(&recs); err != nil {
+			log.Printf("capturePoller: res.All: %q", err)
+			continue
+		}
+
+		for _, rec := range recs {
+			publishCapture(rec)
+			if id := uint64(rec.ID); id > lastID {
+				lastID = id
+			}
+		}
+	}
+}
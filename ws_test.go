@@ -0,0 +1,70 @@
+// Copyright (c) 2012-today José Nieto, https://xiam.io
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/malfunkt/hyperfox/pkg/plugins/capture"
+)
+
+// TestCaptureHubPublishDeliversToSubscriber verifies that a record handed
+// to publish (the entry point publishCapture and, in turn, capturePoller
+// call) reaches a subscriber that was already registered, which is the
+// behavior the whole /ws endpoint depends on.
+func TestCaptureHubPublishDeliversToSubscriber(t *testing.T) {
+	h := newCaptureHub()
+
+	sub := h.subscribe(nil, "")
+	defer h.unsubscribe(sub)
+
+	rec := capture.RecordMeta{UUID: "test-uuid", Host: "example.com"}
+	h.publish(rec)
+
+	select {
+	case got := <-sub.send:
+		if got.UUID != rec.UUID {
+			t.Fatalf("got UUID %q, want %q", got.UUID, rec.UUID)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("subscriber never received the published record")
+	}
+}
+
+// TestCaptureHubPublishFiltersNonMatchingSubscriber verifies that a
+// subscriber's filter terms are honored: a record that doesn't match
+// should never land in its send queue.
+func TestCaptureHubPublishFiltersNonMatchingSubscriber(t *testing.T) {
+	h := newCaptureHub()
+
+	sub := h.subscribe(nil, "other.com")
+	defer h.unsubscribe(sub)
+
+	h.publish(capture.RecordMeta{UUID: "test-uuid", Host: "example.com"})
+
+	select {
+	case got := <-sub.send:
+		t.Fatalf("unexpected record delivered to non-matching subscriber: %+v", got)
+	case <-time.After(100 * time.Millisecond):
+	}
+}